@@ -0,0 +1,167 @@
+package indieauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ctxKey is the type for context keys used by this package, to avoid
+// colliding with keys set by other packages.
+type ctxKey int
+
+// identityCtxKey is the context key under which BearerMiddleware stores the
+// verified Identity.
+const identityCtxKey ctxKey = 0
+
+// Identity holds the principal verified by BearerMiddleware for a request.
+type Identity struct {
+	Me       string `json:"me"`
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+}
+
+// FromContext returns the Identity verified by BearerMiddleware for this
+// request, if any.
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityCtxKey).(*Identity)
+	return id, ok
+}
+
+// bearerCacheEntry pairs a verified Identity with its cache expiration time.
+type bearerCacheEntry struct {
+	identity  *Identity
+	expiresAt time.Time
+}
+
+// bearerCacheKey namespaces bearer token cache entries so they can't collide
+// with the "metadata:" entries discoverFor stores in the same LRU cache.
+func bearerCacheKey(token string) string {
+	return "bearer:" + token
+}
+
+// hasScope reports whether the space-separated scope string contains scope.
+func hasScope(scopes, scope string) bool {
+	for _, s := range strings.Fields(scopes) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyBearerToken checks token against the token verifier endpoint,
+// caching the result in the existing LRU cache for ia.bearerCacheTTL.
+func (ia *IndieAuth) verifyBearerToken(token string) (*Identity, error) {
+	key := bearerCacheKey(token)
+	if v, ok := ia.cache.Get(key); ok {
+		entry := v.(*bearerCacheEntry)
+		if time.Now().Before(entry.expiresAt) {
+			return entry.identity, nil
+		}
+		ia.cache.Remove(key)
+	}
+
+	endpoint := ia.tokenVerifierEndpoint
+	if endpoint == "" {
+		endpoint = ia.tokenEndpoint
+	}
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", ua)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized {
+		return nil, ErrForbidden
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("indieauth: token verifier endpoint answered with status %d", resp.StatusCode)
+	}
+
+	id := &Identity{}
+	if err := json.NewDecoder(resp.Body).Decode(id); err != nil {
+		return nil, err
+	}
+	ia.cache.Add(key, &bearerCacheEntry{identity: id, expiresAt: time.Now().Add(ia.bearerCacheTTL)})
+	return id, nil
+}
+
+// BearerMiddleware protects an API (e.g. Micropub) with an
+// "Authorization: Bearer <token>" (or "?access_token=") header, checked
+// against the token verifier endpoint instead of the cookie session used by
+// Middleware. If scopes is non-empty, every listed scope must be present in
+// the token's scope. The verified Identity is attached to the request
+// context and can be retrieved with FromContext.
+func (ia *IndieAuth) BearerMiddleware(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := bearerToken(r)
+			if token == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			id, err := ia.verifyBearerToken(token)
+			if err != nil {
+				if err == ErrForbidden {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			for _, scope := range scopes {
+				if !hasScope(id.Scope, scope) {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityCtxKey, id)))
+		})
+	}
+}
+
+// Revoke revokes token by calling the token endpoint's revocation action
+// (POST action=revoke), the equivalent of Logout for programmatic clients.
+func (ia *IndieAuth) Revoke(token string) error {
+	endpoint := ia.tokenEndpoint
+	if endpoint == "" {
+		endpoint = ia.authEndpoint
+	}
+	vs := &url.Values{}
+	vs.Set("action", "revoke")
+	vs.Set("token", token)
+
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(vs.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", ua)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("indieauth: revoke failed with status %d", resp.StatusCode)
+	}
+	// Forget any cached verification for this token so BearerMiddleware
+	// doesn't keep honoring it until bearerCacheTTL expires.
+	ia.cache.Remove(bearerCacheKey(token))
+	return nil
+}
@@ -0,0 +1,181 @@
+package indieauth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+type mockVerifierServer struct {
+	revoked map[string]bool
+}
+
+func (s *mockVerifierServer) handler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/revoke" && r.Method == "POST":
+		r.ParseForm()
+		s.revoked[r.Form.Get("token")] = true
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "GET":
+		auth := r.Header.Get("Authorization")
+		token := ""
+		if len(auth) > 7 {
+			token = auth[7:]
+		}
+		if s.revoked[token] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		scope := "create update"
+		if token == "limitedtoken" {
+			scope = "create"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"me":"https://user.example","client_id":"https://client.example","scope":"` + scope + `"}`))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestBearerMiddleware(t *testing.T) {
+	mock := &mockVerifierServer{revoked: map[string]bool{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", mock.handler)
+	mux.HandleFunc("/revoke", mock.handler)
+	mockServer := httptest.NewServer(mux)
+	defer mockServer.Close()
+
+	// me must resolve to an authorization_endpoint for New, so serve one from
+	// a separate "me" server and point the token verifier and token
+	// endpoints at the mock verifier server directly.
+	idxMux := http.NewServeMux()
+	idxMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<!doctype html><html><head><link rel="authorization_endpoint" href="/indieauth"></head></html>`))
+	})
+	meServer := httptest.NewServer(idxMux)
+	defer meServer.Close()
+
+	cookies := sessions.NewCookieStore([]byte("my-secret"))
+	ia, err := New(cookies, meServer.URL, "", WithTokenVerifierEndpoint(mockServer.URL), WithTokenEndpoint(mockServer.URL+"/revoke"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotMe, gotClientID, gotScope string
+	var gotOK bool
+	mux2 := http.NewServeMux()
+	mux2.Handle("/api", ia.BearerMiddleware("create")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, ok := FromContext(r.Context())
+		gotOK = ok
+		if ok {
+			gotMe, gotClientID, gotScope = id.Me, id.ClientID, id.Scope
+		}
+		w.Write([]byte("ok"))
+	})))
+	apiServer := httptest.NewServer(mux2)
+	defer apiServer.Close()
+
+	req, _ := http.NewRequest("GET", apiServer.URL+"/api", nil)
+	req.Header.Set("Authorization", "Bearer sometoken")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if !gotOK || gotMe != "https://user.example" || gotClientID != "https://client.example" || gotScope != "create update" {
+		t.Errorf("unexpected identity: ok=%v me=%q client_id=%q scope=%q", gotOK, gotMe, gotClientID, gotScope)
+	}
+
+	// Missing the required "update" scope.
+	mux3 := http.NewServeMux()
+	mux3.Handle("/strict", ia.BearerMiddleware("create", "update")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+	strictServer := httptest.NewServer(mux3)
+	defer strictServer.Close()
+	req2, _ := http.NewRequest("GET", strictServer.URL+"/strict", nil)
+	req2.Header.Set("Authorization", "Bearer limitedtoken")
+	resp2, err := http.DefaultClient.Do(req2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	if resp2.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for missing scope, got %d", resp2.StatusCode)
+	}
+
+	if err := ia.Revoke("sometoken"); err != nil {
+		t.Fatal(err)
+	}
+	if !mock.revoked["sometoken"] {
+		t.Errorf("expected token to be revoked")
+	}
+
+	req3, _ := http.NewRequest("GET", apiServer.URL+"/api", nil)
+	req3.Header.Set("Authorization", "Bearer sometoken")
+	resp3, err := http.DefaultClient.Do(req3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp3.Body.Close()
+	if resp3.StatusCode != http.StatusForbidden {
+		t.Errorf("expected revoked token to be rejected with 403, got %d", resp3.StatusCode)
+	}
+}
+
+// TestBearerMiddlewareDefaultVerifierEndpoint exercises the default
+// tokenVerifierEndpoint fallback: me's metadata publishes a token_endpoint
+// but no introspection_endpoint, the common case for real-world/legacy
+// IndieAuth servers, so BearerMiddleware must verify against it directly
+// instead of the authorization endpoint.
+func TestBearerMiddlewareDefaultVerifierEndpoint(t *testing.T) {
+	mock := &mockVerifierServer{revoked: map[string]bool{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", mock.handler)
+	mockServer := httptest.NewServer(mux)
+	defer mockServer.Close()
+
+	var meServerURL string
+	idxMux := http.NewServeMux()
+	idxMux.HandleFunc(wellKnownMetadataPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&Metadata{
+			Issuer:                meServerURL,
+			AuthorizationEndpoint: meServerURL + "/indieauth",
+			TokenEndpoint:         mockServer.URL,
+		})
+	})
+	meServer := httptest.NewServer(idxMux)
+	defer meServer.Close()
+	meServerURL = meServer.URL
+
+	cookies := sessions.NewCookieStore([]byte("my-secret"))
+	ia, err := New(cookies, meServer.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux2 := http.NewServeMux()
+	mux2.Handle("/api", ia.BearerMiddleware("create")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})))
+	apiServer := httptest.NewServer(mux2)
+	defer apiServer.Close()
+
+	req, _ := http.NewRequest("GET", apiServer.URL+"/api", nil)
+	req.Header.Set("Authorization", "Bearer sometoken")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+}
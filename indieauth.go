@@ -5,75 +5,187 @@ package indieauth // import "a4.io/go/indieauth"
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/hashicorp/golang-lru"
-	"willnorris.com/go/microformats"
 )
 
 const (
 	ua          = "IndieAuth client (+https://a4.io/go/indieauth)"
 	sessionName = "indieauth"
+
+	// codeVerifierLength is the number of random bytes used to build the
+	// PKCE code verifier, base64url-encoded this yields a 43 char string.
+	codeVerifierLength = 32
+
+	// defaultBearerCacheTTL is how long a verified bearer token stays cached
+	// before BearerMiddleware re-checks it against the token endpoint.
+	defaultBearerCacheTTL = 5 * time.Minute
+)
+
+// PKCE code challenge methods, as defined by RFC 7636.
+const (
+	CodeChallengeMethodS256  = "S256"
+	CodeChallengeMethodPlain = "plain"
 )
 
 // ErrForbidden is returned when the authorization endpoint answered a 403
 var ErrForbidden = errors.New("authorization endpoint answered with forbidden")
 
+// ErrInvalidState is returned when the "state" query parameter on
+// RedirectHandler doesn't match an in-flight authorization request: it is
+// unknown, already redeemed, or expired.
+var ErrInvalidState = errors.New("indieauth: invalid \"state\"")
+
+// ErrInvalidMe is returned when the "me" returned by the authorization
+// endpoint doesn't match the one the flow was started for.
+var ErrInvalidMe = errors.New("indieauth: invalid \"me\"")
+
+// AllowFunc reports whether me is allowed to authenticate against this
+// instance. It gates NewMulti sign-ins; New installs one that only matches
+// the configured identity.
+type AllowFunc func(me string) bool
+
 // IndieAuth holds the auth manager
 type IndieAuth struct {
 	me           string
 	authEndpoint string
-	store        *sessions.CookieStore
+	sessions     SessionStore
+	states       StateStore
 	cache        *lru.Cache
 	clientID     string
 	redirectURI  string
+
+	pkce       bool
+	pkceMethod string
+
+	tokenEndpoint         string
+	tokenVerifierEndpoint string
+	bearerCacheTTL        time.Duration
+
+	metadata *Metadata
+
+	allow        AllowFunc
+	loginTpl     *template.Template
+	loginFunc    func(w http.ResponseWriter, r *http.Request)
+	errorHandler ErrorHandler
+}
+
+// Option customizes an IndieAuth instance at construction time.
+type Option func(*IndieAuth)
+
+// WithPKCE enables or disables PKCE (RFC 7636) support. It is enabled by
+// default using the S256 code challenge method; pass CodeChallengeMethodPlain
+// as method to support older servers that do not implement S256.
+func WithPKCE(enabled bool, method ...string) Option {
+	return func(ia *IndieAuth) {
+		ia.pkce = enabled
+		ia.pkceMethod = CodeChallengeMethodS256
+		if enabled && len(method) > 0 {
+			ia.pkceMethod = method[0]
+		}
+	}
 }
 
-// New initializes a indieauth auth manager
-func New(store *sessions.CookieStore, me, clientID string) (*IndieAuth, error) {
+// WithTokenEndpoint overrides the token endpoint used for Revoke, instead of
+// relying on discovery.
+func WithTokenEndpoint(tokenEndpoint string) Option {
+	return func(ia *IndieAuth) { ia.tokenEndpoint = tokenEndpoint }
+}
+
+// WithTokenVerifierEndpoint overrides the endpoint BearerMiddleware calls to
+// verify a bearer token, instead of defaulting to the discovered
+// introspection endpoint, or to the token endpoint when there is none.
+func WithTokenVerifierEndpoint(tokenVerifierEndpoint string) Option {
+	return func(ia *IndieAuth) { ia.tokenVerifierEndpoint = tokenVerifierEndpoint }
+}
+
+// WithBearerCacheTTL overrides how long BearerMiddleware caches a verified
+// bearer token before re-checking it against the token endpoint.
+func WithBearerCacheTTL(ttl time.Duration) Option {
+	return func(ia *IndieAuth) { ia.bearerCacheTTL = ttl }
+}
+
+// WithAllowFunc overrides which "me" is allowed to authenticate. It is
+// mostly useful with NewMulti, which defaults to allowing any "me".
+func WithAllowFunc(allow AllowFunc) Option {
+	return func(ia *IndieAuth) { ia.allow = allow }
+}
+
+// New initializes a indieauth auth manager for a single, pre-configured "me".
+func New(store *sessions.CookieStore, me, clientID string, opts ...Option) (*IndieAuth, error) {
 	c, err := lru.New(64)
 	if err != nil {
 		return nil, err
 	}
-	authEndpoint, err := getAuthEndpoint(me)
+	states, err := newMemStateStore(64)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get \"authorization_endpoint\": %v", err)
+		return nil, err
+	}
+	md, err := discoverMetadata(me)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover IndieAuth metadata: %v", err)
+	}
+	// Fall back to the authorization endpoint, not RevocationEndpoint (a
+	// distinct endpoint that may differ from TokenEndpoint): many legacy
+	// IndieAuth servers serve token exchange and revocation from the same
+	// URL as authorization.
+	tokenEndpoint := md.TokenEndpoint
+	if tokenEndpoint == "" {
+		tokenEndpoint = md.AuthorizationEndpoint
 	}
 	ia := &IndieAuth{
-		me:           me,
-		clientID:     clientID,
-		redirectURI:  clientID + "/indieauth-redirect",
-		authEndpoint: authEndpoint,
-		store:        store,
-		cache:        c,
+		me:                    me,
+		clientID:              clientID,
+		redirectURI:           clientID + "/indieauth-redirect",
+		authEndpoint:          md.AuthorizationEndpoint,
+		tokenEndpoint:         tokenEndpoint,
+		tokenVerifierEndpoint: md.IntrospectionEndpoint,
+		sessions:              newCookieSessionStore(store),
+		states:                states,
+		cache:                 c,
+		pkce:                  true,
+		pkceMethod:            CodeChallengeMethodS256,
+		bearerCacheTTL:        defaultBearerCacheTTL,
+		metadata:              md,
+		allow: func(candidate string) bool {
+			return normalizeMe(candidate) == normalizeMe(me)
+		},
+	}
+	for _, opt := range opts {
+		opt(ia)
 	}
 	return ia, nil
 }
 
-// getAuthEndpoint calls the "me" URL with a microformats2 parser to fetch the "authorization_endpoint"
-func getAuthEndpoint(me string) (string, error) {
-	req, err := http.NewRequest("GET", me, nil)
-	if err != nil {
+// newCodeVerifier generates a random PKCE code verifier made of unreserved
+// characters, as required by RFC 7636.
+func newCodeVerifier() (string, error) {
+	raw := make([]byte, codeVerifierLength)
+	if _, err := rand.Read(raw); err != nil {
 		return "", err
 	}
-	req.Header.Set("User-Agent", ua)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", nil
-	}
-	defer resp.Body.Close()
-	data := microformats.Parse(resp.Body, resp.Request.URL)
-	authEndpoints := data.Rels["authorization_endpoint"]
-	if len(authEndpoints) == 0 {
-		return "", fmt.Errorf("no authorization_endpoint")
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// codeChallenge derives the code_challenge to send to the authorization
+// endpoint from the given verifier and method.
+func codeChallenge(verifier, method string) string {
+	if method == CodeChallengeMethodPlain {
+		return verifier
 	}
-	return authEndpoints[0], nil
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
 }
 
 type verifyResp struct {
@@ -82,14 +194,19 @@ type verifyResp struct {
 	Scope string `json:"scope"`
 }
 
-// verifyCode calls the authorization endpoint to verify/authenticate the received code
-func (ia *IndieAuth) verifyCode(code string) (*verifyResp, error) {
+// verifyCode calls authEndpoint to verify/authenticate the received code.
+// verifier is the PKCE code_verifier generated in Redirect, it is sent along the code
+// when PKCE is enabled.
+func (ia *IndieAuth) verifyCode(authEndpoint, code, verifier string) (*verifyResp, error) {
 	vs := &url.Values{}
 	vs.Set("code", code)
 	vs.Set("client_id", ia.clientID)
 	vs.Set("redirect_uri", ia.redirectURI)
+	if ia.pkce && verifier != "" {
+		vs.Set("code_verifier", verifier)
+	}
 
-	req, err := http.NewRequest("POST", ia.authEndpoint, strings.NewReader(vs.Encode()))
+	req, err := http.NewRequest("POST", authEndpoint, strings.NewReader(vs.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -106,15 +223,34 @@ func (ia *IndieAuth) verifyCode(code string) (*verifyResp, error) {
 		return nil, ErrForbidden
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, err
+		return nil, fmt.Errorf("indieauth: authorization endpoint answered with status %d", resp.StatusCode)
 	}
 	vresp := &verifyResp{}
 	if err := json.NewDecoder(resp.Body).Decode(vresp); err != nil {
-		panic(err)
+		return nil, fmt.Errorf("indieauth: failed to decode verification response: %v", err)
 	}
 	return vresp, nil
 }
 
+// reportError reports a RedirectHandler/Middleware flow error to the
+// caller's ErrorHandler if one is configured, falling back to a plain
+// http.Error: 403 for ErrForbidden, 400 for ErrInvalidState/ErrInvalidMe,
+// 502 for anything else (treated as an upstream failure).
+func (ia *IndieAuth) reportError(w http.ResponseWriter, r *http.Request, err error) {
+	if ia.errorHandler != nil {
+		ia.errorHandler(w, r, err)
+		return
+	}
+	status := http.StatusBadGateway
+	switch {
+	case errors.Is(err, ErrForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrInvalidState), errors.Is(err, ErrInvalidMe):
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
 // RedirectHandler is a HTTP handler that must be registered on the app at `/indieauth-redirect`
 func (ia *IndieAuth) RedirectHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -124,26 +260,36 @@ func (ia *IndieAuth) RedirectHandler(w http.ResponseWriter, r *http.Request) {
 		code := q.Get("code")
 		state := q.Get("state")
 
-		if me != ia.me {
-			panic("invalid me")
+		rec, err := ia.states.Take(state)
+		if err != nil {
+			ia.reportError(w, r, ErrInvalidState)
+			return
 		}
 
-		p, validState := ia.cache.Get(state)
-		if !validState {
-			panic(fmt.Errorf("invalid state"))
+		if me != rec.Me {
+			ia.reportError(w, r, ErrInvalidMe)
+			return
 		}
 
-		if _, err := ia.verifyCode(code); err != nil {
-			if err == ErrForbidden {
-				w.WriteHeader(http.StatusForbidden)
-				return
-			}
-			panic(err)
+		vresp, err := ia.verifyCode(rec.AuthEndpoint, code, rec.Verifier)
+		if err != nil {
+			ia.reportError(w, r, err)
+			return
 		}
-		session, _ := ia.store.Get(r, sessionName)
-		session.Values["logged_in"] = true
-		session.Save(r, w)
-		http.Redirect(w, r, p.(string), http.StatusTemporaryRedirect)
+
+		// The authorization endpoint's own "me" must match what we started
+		// the flow with, so a shared/multi-tenant endpoint can't vouch for a
+		// different user than the one that requested this session.
+		if normalizeMe(vresp.Me) != normalizeMe(rec.Me) {
+			ia.reportError(w, r, ErrInvalidMe)
+			return
+		}
+
+		if err := ia.sessions.Set(w, r, rec.Me); err != nil {
+			ia.reportError(w, r, err)
+			return
+		}
+		http.Redirect(w, r, rec.RedirectURL, http.StatusTemporaryRedirect)
 
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -152,7 +298,14 @@ func (ia *IndieAuth) RedirectHandler(w http.ResponseWriter, r *http.Request) {
 
 // Redirect responds to the request by redirecting to the authorization endpoint
 func (ia *IndieAuth) Redirect(w http.ResponseWriter, r *http.Request) error {
-	pu, err := url.Parse(ia.authEndpoint)
+	return ia.redirectTo(w, r, ia.me, ia.authEndpoint)
+}
+
+// redirectTo starts the authorization code flow for me against authEndpoint,
+// storing the PKCE verifier (if any) and the return URL under a fresh
+// "state" in the StateStore, shared by Redirect and LoginHandler.
+func (ia *IndieAuth) redirectTo(w http.ResponseWriter, r *http.Request, me, authEndpoint string) error {
+	pu, err := url.Parse(authEndpoint)
 	if err != nil {
 		return err
 	}
@@ -164,41 +317,62 @@ func (ia *IndieAuth) Redirect(w http.ResponseWriter, r *http.Request) error {
 	}
 	state := fmt.Sprintf("%x", rawState)
 
-	// Store the state in the LRU cache
-	ia.cache.Add(state, r.URL.String())
+	rec := &StateRecord{Me: me, AuthEndpoint: authEndpoint, RedirectURL: r.URL.String()}
 
 	// Add the query params
 	q := pu.Query()
-	q.Set("me", ia.me)
+	q.Set("me", me)
 	q.Set("client_id", ia.clientID)
 	q.Set("redirect_uri", ia.redirectURI)
 	q.Set("state", state)
+	if ia.pkce {
+		verifier, err := newCodeVerifier()
+		if err != nil {
+			return err
+		}
+		rec.Verifier = verifier
+		q.Set("code_challenge", codeChallenge(verifier, ia.pkceMethod))
+		q.Set("code_challenge_method", ia.pkceMethod)
+	}
 	pu.RawQuery = q.Encode()
 
-	// Do the redirect
-	http.Redirect(w, r, pu.String(), http.StatusTemporaryRedirect)
+	// Store the state (and the PKCE verifier, if any) in the StateStore
+	if err := ia.states.Put(state, rec, defaultStateTTL); err != nil {
+		return err
+	}
+
+	// See Other rather than Temporary Redirect so a POST (e.g. from
+	// LoginHandler's sign-in form) doesn't get replayed against the
+	// authorization endpoint.
+	http.Redirect(w, r, pu.String(), http.StatusSeeOther)
 	return nil
 }
 
 // Check returns true if there is an existing session with a valid login
 func (ia *IndieAuth) Check(r *http.Request) bool {
-	// Check if there's a session and if the the user is already logged in
-	session, _ := ia.store.Get(r, sessionName)
-	loggedIn, ok := session.Values["logged_in"]
-	return ok && loggedIn.(bool)
+	loggedIn, _, err := ia.sessions.Get(r)
+	return err == nil && loggedIn
+}
+
+// Me returns the "me" URL authenticated in the current session, if any. It
+// is mostly useful with NewMulti, where the identity isn't known upfront.
+func (ia *IndieAuth) Me(r *http.Request) (string, bool) {
+	_, me, err := ia.sessions.Get(r)
+	if err != nil || me == "" {
+		return "", false
+	}
+	return me, true
 }
 
-// Middleware provides a middleware that will only only user authenticated against with the indieauth endpoint
+// Middleware provides a middleware that will only only user authenticated against with the indieauth endpoint.
+// It requires a fixed "me", as configured by New; for multi-tenant sign-in, use LoginHandler instead.
 func (ia *IndieAuth) Middleware() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.URL.String() != "/indieauth-redirect" && !ia.Check(r) {
 				if err := ia.Redirect(w, r); err != nil {
-					if err == ErrForbidden {
-						w.WriteHeader(http.StatusForbidden)
-						return
-					}
-					panic(err)
+					ia.reportError(w, r, err)
+					return
 				}
 				return
 			}
@@ -212,7 +386,5 @@ func (ia *IndieAuth) Middleware() func(http.Handler) http.Handler {
 
 // Logout logs out the current user
 func (ia *IndieAuth) Logout(w http.ResponseWriter, r *http.Request) {
-	session, _ := ia.store.Get(r, "indieauth")
-	session.Values["logged_in"] = false
-	session.Save(r, w)
+	ia.sessions.Clear(w, r)
 }
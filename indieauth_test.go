@@ -1,6 +1,8 @@
 package indieauth
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -20,6 +22,13 @@ type mockIndieAuthServer struct {
 
 	indexCall, authCall, verifCall int
 
+	// gotCodeChallenge/gotCodeChallengeMethod capture what the client sent to
+	// the authorization endpoint, gotCodeVerifier captures what it later sent
+	// back when exchanging the code, so tests can assert the PKCE round-trip.
+	gotCodeChallenge       string
+	gotCodeChallengeMethod string
+	gotCodeVerifier        string
+
 	t *testing.T
 	s *httptest.Server
 }
@@ -35,10 +44,14 @@ func (s *mockIndieAuthServer) AuthHandler(w http.ResponseWriter, r *http.Request
 	case "GET":
 		s.authCall++
 		s.t.Logf("MockIndieAuthServer GET /indieauth")
+		s.gotCodeChallenge = r.URL.Query().Get("code_challenge")
+		s.gotCodeChallengeMethod = r.URL.Query().Get("code_challenge_method")
 		http.Redirect(w, r, r.URL.Query().Get("redirect_uri")+"?code="+s.Code+"&state="+r.URL.Query().Get("state")+"&me="+r.URL.Query().Get("me"), http.StatusTemporaryRedirect)
 	case "POST":
 		s.verifCall++
 		s.t.Logf("MockIndieAuthServer POST /indieauth")
+		r.ParseForm()
+		s.gotCodeVerifier = r.Form.Get("code_verifier")
 		w.Header().Set("Content-Type", "application/json")
 		// FIXME(tsileo): vary this and return 403
 		w.Write([]byte("{\"me\":\"" + s.Me + "\"}"))
@@ -59,115 +72,150 @@ func newMockIndieAuthServer(t *testing.T) *mockIndieAuthServer {
 	return mockServer
 }
 
-func TestAuthorizationEndpointDiscoveryLinkTag(t *testing.T) {
+func TestMiddleware(t *testing.T) {
+	cookies := sessions.NewCookieStore([]byte("my-secret"))
+
+	mockServer := newMockIndieAuthServer(t)
+
+	// The mux is wired up after the server starts so clientID/redirectURI
+	// is the app's own absolute URL, not a relative path the mock IdP's
+	// redirect would resolve against its own origin instead of ours.
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(fmt.Sprintf(`<!doctype html><html><head><meta charset=utf-8><link rel="authorization_endpoint" href="/indieauth"></head></html>`)))
-	})
 	server := httptest.NewServer(mux)
+	defer server.Close()
 
-	authEndpoint, err := getAuthEndpoint(server.URL)
+	// Create a server that use the lib
+	s, err := New(cookies, mockServer.Me, server.URL)
 	if err != nil {
 		panic(err)
 	}
+	m := s.Middleware()
 
-	if authEndpoint != server.URL+"/indieauth" {
-		t.Errorf("failed to discover authorization endpoint, expected \"%s/indieauth\", got %q", server.URL, authEndpoint)
-	}
-}
+	mux.HandleFunc("/indieauth-redirect", s.RedirectHandler)
+	mux.Handle("/", m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Logf("hello")
+		w.Write([]byte("hello"))
+	})))
 
-func TestAuthorizationEndpointDiscoveryLinkHeader(t *testing.T) {
-	mux := http.NewServeMux()
-	var serverURL string
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Link", fmt.Sprintf("<%s/indieauth>; rel=\"authorization_endpoint\"", serverURL))
-	})
-	server := httptest.NewServer(mux)
-	serverURL = server.URL
+	// Setup a client with cookies support
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	authEndpoint, err := getAuthEndpoint(server.URL)
+	client := &http.Client{
+		Jar: jar,
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		panic(err)
 	}
+	if string(data) != "hello" {
+		t.Errorf("bad response, expected \"hello\", got \"%s\"", data)
+	}
+	if mockServer.authCall != 1 {
+		t.Errorf("the authorization endpoint wasn't called")
+	}
+	if mockServer.verifCall != 1 {
+		t.Errorf("code was not verified")
+	}
 
-	if authEndpoint != serverURL+"/indieauth" {
-		t.Errorf("failed to discover authorization endpoint, expected \"%s/indieauth\", got %q", serverURL, authEndpoint)
+	// PKCE is enabled by default, using S256
+	if mockServer.gotCodeChallenge == "" {
+		t.Errorf("expected a code_challenge to be sent")
+	}
+	if mockServer.gotCodeChallengeMethod != CodeChallengeMethodS256 {
+		t.Errorf("expected code_challenge_method %q, got %q", CodeChallengeMethodS256, mockServer.gotCodeChallengeMethod)
+	}
+	if mockServer.gotCodeVerifier == "" {
+		t.Errorf("expected the code_verifier to be sent back when exchanging the code")
+	}
+	sum := sha256.Sum256([]byte(mockServer.gotCodeVerifier))
+	if mockServer.gotCodeChallenge != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Errorf("code_challenge does not match sha256(code_verifier)")
 	}
 }
 
-func TestAuthorizationEndpointDiscovery(t *testing.T) {
+func TestPKCEPlain(t *testing.T) {
+	cookies := sessions.NewCookieStore([]byte("my-secret"))
+	mockServer := newMockIndieAuthServer(t)
+
 	mux := http.NewServeMux()
-	var serverURL string
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// From the spec (https://www.w3.org/TR/indieauth/#x4-1-discovery-by-clients):
-		// >>> the first HTTP Link header takes precedence, followed by the first <link> element in document order.
-		// The client should discover `serverURL + "/lol"`
-		w.Header().Set("Link", fmt.Sprintf("<%s/lol>; rel=\"authorization_endpoint\"", serverURL))
-		w.Write([]byte(fmt.Sprintf(`<!doctype html><html><head><meta charset=utf-8><link rel="authorization_endpoint" href="/indieauth"></head></html>`)))
-	})
 	server := httptest.NewServer(mux)
-	serverURL = server.URL
+	defer server.Close()
 
-	authEndpoint, err := getAuthEndpoint(server.URL)
+	s, err := New(cookies, mockServer.Me, server.URL, WithPKCE(true, CodeChallengeMethodPlain))
 	if err != nil {
 		panic(err)
 	}
+	m := s.Middleware()
+
+	mux.HandleFunc("/indieauth-redirect", s.RedirectHandler)
+	mux.Handle("/", m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})))
 
-	if authEndpoint != serverURL+"/lol" {
-		t.Errorf("failed to discover authorization endpoint, expected \"%s/lol\", got %q", serverURL, authEndpoint)
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		panic(err)
 	}
+	defer resp.Body.Close()
 
+	if mockServer.gotCodeChallengeMethod != CodeChallengeMethodPlain {
+		t.Errorf("expected code_challenge_method %q, got %q", CodeChallengeMethodPlain, mockServer.gotCodeChallengeMethod)
+	}
+	if mockServer.gotCodeChallenge != mockServer.gotCodeVerifier {
+		t.Errorf("expected code_challenge to equal the verifier in plain mode, got %q != %q", mockServer.gotCodeChallenge, mockServer.gotCodeVerifier)
+	}
 }
 
-func TestMiddleware(t *testing.T) {
+func TestPKCEDisabled(t *testing.T) {
 	cookies := sessions.NewCookieStore([]byte("my-secret"))
-
 	mockServer := newMockIndieAuthServer(t)
 
-	// Create a server that use the lib
-	s, err := New(cookies, mockServer.Me)
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	s, err := New(cookies, mockServer.Me, server.URL, WithPKCE(false))
 	if err != nil {
 		panic(err)
 	}
 	m := s.Middleware()
 
-	mux := http.NewServeMux()
 	mux.HandleFunc("/indieauth-redirect", s.RedirectHandler)
 	mux.Handle("/", m(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		t.Logf("hello")
 		w.Write([]byte("hello"))
 	})))
 
-	server := httptest.NewServer(mux)
-
-	// Setup a client with cookies support
 	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	client := &http.Client{
-		Jar: jar,
-	}
+	client := &http.Client{Jar: jar}
 	resp, err := client.Get(server.URL)
 	if err != nil {
 		panic(err)
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		t.Errorf("expected 200, got %d", resp.StatusCode)
-	}
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		panic(err)
-	}
-	if string(data) != "hello" {
-		t.Errorf("bad response, expected \"hello\", got \"%s\"", data)
-	}
-	if mockServer.authCall != 1 {
-		t.Errorf("the authorization endpoint wasn't called")
+
+	if mockServer.gotCodeChallenge != "" {
+		t.Errorf("expected no code_challenge to be sent, got %q", mockServer.gotCodeChallenge)
 	}
-	if mockServer.verifCall != 1 {
-		t.Errorf("code was not verified")
+	if mockServer.gotCodeVerifier != "" {
+		t.Errorf("expected no code_verifier to be sent, got %q", mockServer.gotCodeVerifier)
 	}
 }
@@ -0,0 +1,167 @@
+package indieauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"willnorris.com/go/microformats"
+)
+
+// metadataRel is the link relation used to point at the IndieAuth metadata
+// document, per https://indieauth.spec.indieweb.org/#discovery-by-clients
+const metadataRel = "indieauth-metadata"
+
+// wellKnownMetadataPath is the default location of the metadata document
+// when no "indieauth-metadata" link is advertised.
+const wellKnownMetadataPath = "/.well-known/oauth-authorization-server"
+
+// Metadata describes the endpoints and capabilities of an IndieAuth server,
+// as exposed by its metadata document (or, absent one, reconstructed from
+// the legacy rel-based discovery).
+type Metadata struct {
+	Issuer                        string   `json:"issuer"`
+	AuthorizationEndpoint         string   `json:"authorization_endpoint"`
+	TokenEndpoint                 string   `json:"token_endpoint"`
+	IntrospectionEndpoint         string   `json:"introspection_endpoint"`
+	RevocationEndpoint            string   `json:"revocation_endpoint"`
+	ScopesSupported               []string `json:"scopes_supported"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+	GrantTypesSupported           []string `json:"grant_types_supported"`
+}
+
+// discoverMetadata resolves the IndieAuth server metadata for me: it fetches
+// me, looks for a "indieauth-metadata" link (HTTP Link header or HTML <link>)
+// and, failing that, the well-known metadata document location; if neither
+// is served it falls back to the legacy rels-based discovery, which only
+// yields an AuthorizationEndpoint.
+func discoverMetadata(me string) (*Metadata, error) {
+	req, err := http.NewRequest("GET", me, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", ua)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	baseURL := resp.Request.URL
+
+	rels := mergeRels(
+		parseLinkHeaderRels(resp.Header.Get("Link"), baseURL),
+		microformats.Parse(strings.NewReader(string(body)), baseURL).Rels,
+	)
+
+	metadataURL := ""
+	if urls := rels[metadataRel]; len(urls) > 0 {
+		metadataURL = urls[0]
+	} else {
+		metadataURL = baseURL.Scheme + "://" + baseURL.Host + wellKnownMetadataPath
+	}
+
+	if md, err := fetchMetadata(metadataURL); err == nil {
+		if err := validateIssuer(md.Issuer, me); err != nil {
+			return nil, err
+		}
+		return md, nil
+	}
+
+	// No metadata document available: fall back to the legacy rels-based
+	// discovery of just the authorization_endpoint.
+	authEndpoints := rels["authorization_endpoint"]
+	if len(authEndpoints) == 0 {
+		return nil, fmt.Errorf("indieauth: no authorization_endpoint")
+	}
+	return &Metadata{AuthorizationEndpoint: authEndpoints[0]}, nil
+}
+
+// fetchMetadata GETs and decodes the JSON metadata document at metadataURL.
+func fetchMetadata(metadataURL string) (*Metadata, error) {
+	req, err := http.NewRequest("GET", metadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", ua)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("indieauth: metadata endpoint answered with status %d", resp.StatusCode)
+	}
+	md := &Metadata{}
+	if err := json.NewDecoder(resp.Body).Decode(md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// validateIssuer checks that issuer matches the origin of me, as required by
+// the spec to prevent mix-up attacks.
+func validateIssuer(issuer, me string) error {
+	meURL, err := url.Parse(me)
+	if err != nil {
+		return err
+	}
+	issuerURL, err := url.Parse(issuer)
+	if err != nil {
+		return fmt.Errorf("indieauth: invalid \"issuer\": %v", err)
+	}
+	if issuerURL.Scheme != meURL.Scheme || issuerURL.Host != meURL.Host {
+		return fmt.Errorf("indieauth: \"issuer\" %q does not match %q", issuer, me)
+	}
+	return nil
+}
+
+// parseLinkHeaderRels parses a HTTP Link header (RFC 8288) into a
+// rel -> URLs map, resolving relative URLs against base.
+func parseLinkHeaderRels(header string, base *url.URL) map[string][]string {
+	rels := map[string][]string{}
+	if header == "" {
+		return rels
+	}
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		raw := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+		ref, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		for _, attr := range parts[1:] {
+			attr = strings.TrimSpace(attr)
+			if !strings.HasPrefix(attr, "rel=") {
+				continue
+			}
+			rel := strings.Trim(strings.TrimPrefix(attr, "rel="), `"`)
+			rels[rel] = append(rels[rel], base.ResolveReference(ref).String())
+		}
+	}
+	return rels
+}
+
+// mergeRels merges rel -> URLs maps, giving precedence to the entries in a:
+// per the spec, a HTTP Link header takes precedence over a HTML <link> in
+// the body for the same relation.
+func mergeRels(a, b map[string][]string) map[string][]string {
+	merged := map[string][]string{}
+	for rel, urls := range b {
+		merged[rel] = urls
+	}
+	for rel, urls := range a {
+		merged[rel] = urls
+	}
+	return merged
+}
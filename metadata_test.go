@@ -0,0 +1,141 @@
+package indieauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetadataDiscoveryFallbackLinkTag(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<!doctype html><html><head><meta charset=utf-8><link rel="authorization_endpoint" href="/indieauth"></head></html>`))
+	})
+	server := httptest.NewServer(mux)
+
+	md, err := discoverMetadata(server.URL)
+	if err != nil {
+		panic(err)
+	}
+
+	if md.AuthorizationEndpoint != server.URL+"/indieauth" {
+		t.Errorf("failed to discover authorization endpoint, expected \"%s/indieauth\", got %q", server.URL, md.AuthorizationEndpoint)
+	}
+}
+
+func TestMetadataDiscoveryFallbackLinkHeader(t *testing.T) {
+	mux := http.NewServeMux()
+	var serverURL string
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", fmt.Sprintf("<%s/indieauth>; rel=\"authorization_endpoint\"", serverURL))
+	})
+	server := httptest.NewServer(mux)
+	serverURL = server.URL
+
+	md, err := discoverMetadata(server.URL)
+	if err != nil {
+		panic(err)
+	}
+
+	if md.AuthorizationEndpoint != serverURL+"/indieauth" {
+		t.Errorf("failed to discover authorization endpoint, expected \"%s/indieauth\", got %q", serverURL, md.AuthorizationEndpoint)
+	}
+}
+
+func TestMetadataDiscoveryFallback(t *testing.T) {
+	mux := http.NewServeMux()
+	var serverURL string
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		// From the spec (https://www.w3.org/TR/indieauth/#x4-1-discovery-by-clients):
+		// >>> the first HTTP Link header takes precedence, followed by the first <link> element in document order.
+		// The client should discover `serverURL + "/lol"`
+		w.Header().Set("Link", fmt.Sprintf("<%s/lol>; rel=\"authorization_endpoint\"", serverURL))
+		w.Write([]byte(`<!doctype html><html><head><meta charset=utf-8><link rel="authorization_endpoint" href="/indieauth"></head></html>`))
+	})
+	server := httptest.NewServer(mux)
+	serverURL = server.URL
+
+	md, err := discoverMetadata(server.URL)
+	if err != nil {
+		panic(err)
+	}
+
+	if md.AuthorizationEndpoint != serverURL+"/lol" {
+		t.Errorf("failed to discover authorization endpoint, expected \"%s/lol\", got %q", serverURL, md.AuthorizationEndpoint)
+	}
+}
+
+func TestMetadataDiscoveryWellKnown(t *testing.T) {
+	mux := http.NewServeMux()
+	var serverURL string
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<!doctype html><html></html>`))
+	})
+	mux.HandleFunc(wellKnownMetadataPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&Metadata{
+			Issuer:                serverURL,
+			AuthorizationEndpoint: serverURL + "/indieauth",
+			TokenEndpoint:         serverURL + "/token",
+			IntrospectionEndpoint: serverURL + "/introspect",
+			RevocationEndpoint:    serverURL + "/revoke",
+			ScopesSupported:       []string{"create", "update"},
+		})
+	})
+	server := httptest.NewServer(mux)
+	serverURL = server.URL
+
+	md, err := discoverMetadata(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.AuthorizationEndpoint != serverURL+"/indieauth" || md.TokenEndpoint != serverURL+"/token" {
+		t.Errorf("unexpected metadata: %+v", md)
+	}
+}
+
+func TestMetadataDiscoveryIndieAuthMetadataLink(t *testing.T) {
+	mux := http.NewServeMux()
+	var serverURL string
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", fmt.Sprintf("<%s/meta.json>; rel=\"indieauth-metadata\"", serverURL))
+	})
+	mux.HandleFunc("/meta.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&Metadata{
+			Issuer:                serverURL,
+			AuthorizationEndpoint: serverURL + "/custom-auth",
+		})
+	})
+	server := httptest.NewServer(mux)
+	serverURL = server.URL
+
+	md, err := discoverMetadata(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.AuthorizationEndpoint != serverURL+"/custom-auth" {
+		t.Errorf("expected the indieauth-metadata link to be followed, got %+v", md)
+	}
+}
+
+func TestMetadataDiscoveryIssuerMismatch(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<!doctype html><html></html>`))
+	})
+	mux.HandleFunc(wellKnownMetadataPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&Metadata{
+			Issuer:                "https://not-me.example",
+			AuthorizationEndpoint: "https://not-me.example/indieauth",
+		})
+	})
+	server := httptest.NewServer(mux)
+
+	if _, err := discoverMetadata(server.URL); err == nil {
+		t.Errorf("expected an issuer mismatch to be rejected")
+	}
+}
@@ -0,0 +1,145 @@
+package indieauth
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/hashicorp/golang-lru"
+)
+
+// NewMulti initializes a multi-tenant indieauth auth manager that lets any
+// IndieWeb user sign in, instead of being locked to a single hardcoded "me"
+// like New. Use WithAllowFunc to restrict which "me" are accepted (it
+// defaults to allowing any), and LoginHandler (instead of Middleware, which
+// requires a fixed "me") to let visitors submit their own identity.
+func NewMulti(store *sessions.CookieStore, clientID string, opts ...Option) (*IndieAuth, error) {
+	c, err := lru.New(64)
+	if err != nil {
+		return nil, err
+	}
+	states, err := newMemStateStore(64)
+	if err != nil {
+		return nil, err
+	}
+	ia := &IndieAuth{
+		clientID:       clientID,
+		redirectURI:    clientID + "/indieauth-redirect",
+		sessions:       newCookieSessionStore(store),
+		states:         states,
+		cache:          c,
+		pkce:           true,
+		pkceMethod:     CodeChallengeMethodS256,
+		bearerCacheTTL: defaultBearerCacheTTL,
+		allow:          func(string) bool { return true },
+	}
+	for _, opt := range opts {
+		opt(ia)
+	}
+	return ia, nil
+}
+
+// WithLoginTemplate renders the LoginHandler's sign-in form with the given
+// template.
+func WithLoginTemplate(tpl *template.Template) Option {
+	return func(ia *IndieAuth) { ia.loginTpl = tpl }
+}
+
+// WithLoginFunc delegates rendering of the sign-in form to fn instead of a
+// template, for integrators who want full control over the response.
+func WithLoginFunc(fn func(w http.ResponseWriter, r *http.Request)) Option {
+	return func(ia *IndieAuth) { ia.loginFunc = fn }
+}
+
+// normalizeMe canonicalizes a user-submitted "me" URL: it defaults to the
+// https scheme when none is given, and ensures a path of at least "/", so
+// equivalent profile URLs cache and compare the same way.
+func normalizeMe(me string) string {
+	if me == "" {
+		return ""
+	}
+	if !strings.Contains(me, "://") {
+		me = "https://" + me
+	}
+	u, err := url.Parse(me)
+	if err != nil {
+		return me
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String()
+}
+
+// renderLogin shows the sign-in form, preferring a caller-supplied
+// LoginFunc over a template.
+func (ia *IndieAuth) renderLogin(w http.ResponseWriter, r *http.Request) {
+	if ia.loginFunc != nil {
+		ia.loginFunc(w, r)
+		return
+	}
+	if ia.loginTpl != nil {
+		if err := ia.loginTpl.Execute(w, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Error(w, "indieauth: no login template or login func configured", http.StatusInternalServerError)
+}
+
+// LoginHandler is a HTTP handler that lets a visitor sign in with their own
+// "me" URL: GET renders the sign-in form, POST (submitted from that form)
+// discovers the visitor's IndieAuth metadata and redirects them to their own
+// authorization endpoint.
+func (ia *IndieAuth) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		ia.renderLogin(w, r)
+
+	case "POST":
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "indieauth: bad request", http.StatusBadRequest)
+			return
+		}
+		me := normalizeMe(r.Form.Get("me"))
+		if me == "" {
+			http.Error(w, "indieauth: missing \"me\"", http.StatusBadRequest)
+			return
+		}
+		if ia.allow != nil && !ia.allow(me) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		md, err := ia.discoverFor(me)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		if err := ia.redirectTo(w, r, me, md.AuthorizationEndpoint); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// discoverFor resolves me's IndieAuth metadata, caching it in the existing
+// LRU cache keyed by the normalized "me" so repeated sign-ins don't
+// re-discover it every time.
+func (ia *IndieAuth) discoverFor(me string) (*Metadata, error) {
+	key := "metadata:" + me
+	if v, ok := ia.cache.Get(key); ok {
+		return v.(*Metadata), nil
+	}
+	md, err := discoverMetadata(me)
+	if err != nil {
+		return nil, err
+	}
+	ia.cache.Add(key, md)
+	return md, nil
+}
@@ -0,0 +1,95 @@
+package indieauth
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/net/publicsuffix"
+)
+
+func TestMultiLogin(t *testing.T) {
+	cookies := sessions.NewCookieStore([]byte("my-secret"))
+
+	mockServer := newMockIndieAuthServer(t)
+
+	// The mux is wired up after the server starts so the client_id/redirect_uri
+	// sent to the authorization endpoint can be the app's own absolute URL.
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ia, err := NewMulti(cookies, server.URL, WithLoginTemplate(template.Must(template.New("login").Parse("login form"))))
+	if err != nil {
+		panic(err)
+	}
+	mux.HandleFunc("/login", ia.LoginHandler)
+	mux.HandleFunc("/indieauth-redirect", ia.RedirectHandler)
+	mux.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		me, ok := ia.Me(r)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(me))
+	})
+
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+
+	resp, err := client.PostForm(server.URL+"/login", url.Values{"me": {mockServer.Me}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected login to complete with 200, got %d", resp.StatusCode)
+	}
+
+	meResp, err := client.Get(server.URL + "/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer meResp.Body.Close()
+	data, _ := ioutil.ReadAll(meResp.Body)
+	if string(data) != normalizeMe(mockServer.Me) {
+		t.Errorf("expected Me() to return %q, got %q", normalizeMe(mockServer.Me), data)
+	}
+	if mockServer.authCall != 1 {
+		t.Errorf("the authorization endpoint wasn't called")
+	}
+}
+
+func TestMultiLoginDisallowed(t *testing.T) {
+	cookies := sessions.NewCookieStore([]byte("my-secret"))
+	mockServer := newMockIndieAuthServer(t)
+
+	ia, err := NewMulti(cookies, "",
+		WithLoginTemplate(template.Must(template.New("login").Parse("login form"))),
+		WithAllowFunc(func(me string) bool { return false }),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", ia.LoginHandler)
+	server := httptest.NewServer(mux)
+
+	resp, err := http.PostForm(server.URL+"/login", url.Values{"me": {mockServer.Me}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a disallowed \"me\" to be rejected with 403, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build redis
+// +build redis
+
+package indieauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RedisStateStore is a StateStore backed by Redis, so the authorization
+// code flow can be started on one process and completed on another, e.g.
+// behind a load balancer. It is only compiled in when building with the
+// "redis" tag (go build -tags redis), so the default build doesn't gain a
+// dependency on a Redis client.
+type RedisStateStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStateStore wraps an existing Redis client. prefix is prepended to
+// every key, e.g. "indieauth:state:", to namespace the state records.
+func NewRedisStateStore(client *redis.Client, prefix string) *RedisStateStore {
+	return &RedisStateStore{client: client, prefix: prefix}
+}
+
+// Put implements StateStore.
+func (s *RedisStateStore) Put(state string, rec *StateRecord, ttl time.Duration) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(s.prefix+state, data, ttl).Err()
+}
+
+// Take implements StateStore.
+func (s *RedisStateStore) Take(state string) (*StateRecord, error) {
+	key := s.prefix + state
+	data, err := s.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("indieauth: redis state lookup failed: %v", err)
+	}
+	s.client.Del(key)
+	rec := &StateRecord{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
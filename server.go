@@ -0,0 +1,559 @@
+package indieauth
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"willnorris.com/go/microformats"
+)
+
+// ErrNotFound is returned by a CodeStore/TokenStore when the requested code
+// or token does not exist, has already been redeemed, or has expired.
+var ErrNotFound = errors.New("indieauth: not found")
+
+// defaultCodeTTL is how long an authorization code stays valid if the
+// integrator does not override it via WithCodeTTL.
+const defaultCodeTTL = 10 * time.Minute
+
+// AuthorizationRequest holds the parameters of an in-progress authorization
+// request, as parsed from the authorization endpoint query/form values.
+type AuthorizationRequest struct {
+	Me                  string
+	ClientID            string
+	RedirectURI         string
+	State               string
+	Scope               string
+	ResponseType        string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// AuthorizationCode holds the data associated with a one-time authorization
+// code issued by the AuthorizationHandler.
+type AuthorizationCode struct {
+	ClientID            string
+	RedirectURI         string
+	Me                  string
+	Scope               string
+	ResponseType        string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// Token holds the data associated with a bearer token issued by the
+// TokenHandler.
+type Token struct {
+	Me       string
+	ClientID string
+	Scope    string
+}
+
+// CodeStore persists the one-time authorization codes issued by the
+// authorization endpoint. Implementations must make Take delete the code so
+// it can only ever be redeemed once, and must expire codes after ttl.
+type CodeStore interface {
+	Put(code string, data *AuthorizationCode, ttl time.Duration) error
+	Take(code string) (*AuthorizationCode, error)
+}
+
+// TokenStore persists the bearer tokens issued by the token endpoint.
+type TokenStore interface {
+	Put(token string, data *Token) error
+	Get(token string) (*Token, error)
+	Delete(token string) error
+}
+
+// Authenticator authenticates the current visitor against the integrator's
+// own login system, returning their "me" profile URL if they're logged in.
+type Authenticator func(r *http.Request) (me string, ok bool)
+
+// IndieAuthServer implements the authorization_endpoint and token_endpoint
+// side of IndieAuth, so a site can become its own identity provider.
+type IndieAuthServer struct {
+	codes  CodeStore
+	tokens TokenStore
+
+	authenticator Authenticator
+	consentTpl    *template.Template
+	consentFunc   func(w http.ResponseWriter, r *http.Request, req *AuthorizationRequest)
+
+	codeTTL time.Duration
+}
+
+// ServerOption customizes an IndieAuthServer at construction time.
+type ServerOption func(*IndieAuthServer)
+
+// WithCodeStore overrides the default in-memory CodeStore, e.g. with a SQL-backed implementation.
+func WithCodeStore(store CodeStore) ServerOption {
+	return func(s *IndieAuthServer) { s.codes = store }
+}
+
+// WithTokenStore overrides the default in-memory TokenStore, e.g. with a SQL-backed implementation.
+func WithTokenStore(store TokenStore) ServerOption {
+	return func(s *IndieAuthServer) { s.tokens = store }
+}
+
+// WithConsentTemplate renders the consent page with the given template,
+// executed with an *AuthorizationRequest as its data.
+func WithConsentTemplate(tpl *template.Template) ServerOption {
+	return func(s *IndieAuthServer) { s.consentTpl = tpl }
+}
+
+// WithConsentFunc delegates rendering of the consent page to fn instead of a
+// template, for integrators who want full control over the response.
+func WithConsentFunc(fn func(w http.ResponseWriter, r *http.Request, req *AuthorizationRequest)) ServerOption {
+	return func(s *IndieAuthServer) { s.consentFunc = fn }
+}
+
+// WithCodeTTL overrides how long an issued authorization code stays valid.
+func WithCodeTTL(ttl time.Duration) ServerOption {
+	return func(s *IndieAuthServer) { s.codeTTL = ttl }
+}
+
+// NewServer initializes an IndieAuthServer. authenticator gates the consent
+// step behind the integrator's own login system, it is called on every
+// request to the authorization endpoint.
+func NewServer(authenticator Authenticator, opts ...ServerOption) (*IndieAuthServer, error) {
+	codes, err := newMemCodeStore(256)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := newMemTokenStore(256)
+	if err != nil {
+		return nil, err
+	}
+	s := &IndieAuthServer{
+		authenticator: authenticator,
+		codes:         codes,
+		tokens:        tokens,
+		codeTTL:       defaultCodeTTL,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// parseAuthorizationRequest validates and extracts the IndieAuth parameters
+// from the given query/form values.
+func parseAuthorizationRequest(vs url.Values) (*AuthorizationRequest, error) {
+	req := &AuthorizationRequest{
+		ClientID:            vs.Get("client_id"),
+		RedirectURI:         vs.Get("redirect_uri"),
+		State:               vs.Get("state"),
+		Scope:               vs.Get("scope"),
+		ResponseType:        vs.Get("response_type"),
+		CodeChallenge:       vs.Get("code_challenge"),
+		CodeChallengeMethod: vs.Get("code_challenge_method"),
+	}
+	if req.ClientID == "" {
+		return nil, errors.New("indieauth: missing \"client_id\"")
+	}
+	if req.RedirectURI == "" {
+		return nil, errors.New("indieauth: missing \"redirect_uri\"")
+	}
+	if req.State == "" {
+		return nil, errors.New("indieauth: missing \"state\"")
+	}
+	if req.ResponseType == "" {
+		req.ResponseType = "id"
+	}
+	if req.ResponseType != "code" && req.ResponseType != "id" {
+		return nil, fmt.Errorf("indieauth: invalid \"response_type\" %q", req.ResponseType)
+	}
+	if req.CodeChallenge != "" && req.CodeChallengeMethod == "" {
+		req.CodeChallengeMethod = CodeChallengeMethodS256
+	}
+	return req, nil
+}
+
+// validateRedirectURI checks that redirectURI is allowed for clientID, per
+// https://indieauth.spec.indieweb.org/#authorization-request: either they
+// share a host, or clientID's page advertises redirectURI via a
+// rel="redirect_uri" link (HTTP Link header or HTML <link>/<a>). This is
+// the check that stands in for client registration in IndieAuth, so it
+// must pass before a code is ever issued.
+func validateRedirectURI(clientID, redirectURI string) error {
+	cu, err := url.Parse(clientID)
+	if err != nil {
+		return fmt.Errorf("indieauth: invalid \"client_id\": %v", err)
+	}
+	ru, err := url.Parse(redirectURI)
+	if err != nil {
+		return fmt.Errorf("indieauth: invalid \"redirect_uri\": %v", err)
+	}
+	if ru.Host == cu.Host {
+		return nil
+	}
+
+	req, err := http.NewRequest("GET", clientID, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", ua)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("indieauth: failed to fetch \"client_id\" %q: %v", clientID, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	baseURL := resp.Request.URL
+
+	rels := mergeRels(
+		parseLinkHeaderRels(resp.Header.Get("Link"), baseURL),
+		microformats.Parse(strings.NewReader(string(body)), baseURL).Rels,
+	)
+	for _, u := range rels["redirect_uri"] {
+		if u == redirectURI {
+			return nil
+		}
+	}
+	return fmt.Errorf("indieauth: \"redirect_uri\" %q does not belong to \"client_id\" %q", redirectURI, clientID)
+}
+
+// renderConsent shows the consent page for req, preferring a caller-supplied
+// ConsentFunc over a template.
+func (s *IndieAuthServer) renderConsent(w http.ResponseWriter, r *http.Request, req *AuthorizationRequest) {
+	if s.consentFunc != nil {
+		s.consentFunc(w, r, req)
+		return
+	}
+	if s.consentTpl != nil {
+		if err := s.consentTpl.Execute(w, req); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Error(w, "indieauth: no consent template or consent func configured", http.StatusInternalServerError)
+}
+
+// AuthorizationHandler is a HTTP handler implementing the authorization_endpoint.
+// GET renders the consent page, POST (submitted from that page) issues the code.
+func (s *IndieAuthServer) AuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		req, err := parseAuthorizationRequest(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateRedirectURI(req.ClientID, req.RedirectURI); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		me, ok := s.authenticator(r)
+		if !ok {
+			http.Error(w, "indieauth: authentication required", http.StatusUnauthorized)
+			return
+		}
+		req.Me = me
+		s.renderConsent(w, r, req)
+
+	case "POST":
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "indieauth: bad request", http.StatusBadRequest)
+			return
+		}
+		req, err := parseAuthorizationRequest(r.Form)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateRedirectURI(req.ClientID, req.RedirectURI); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		me, ok := s.authenticator(r)
+		if !ok {
+			http.Error(w, "indieauth: authentication required", http.StatusUnauthorized)
+			return
+		}
+		req.Me = me
+
+		ru, err := url.Parse(req.RedirectURI)
+		if err != nil {
+			http.Error(w, "indieauth: invalid \"redirect_uri\"", http.StatusBadRequest)
+			return
+		}
+		q := ru.Query()
+		q.Set("state", req.State)
+
+		if r.Form.Get("decision") != "allow" {
+			q.Set("error", "access_denied")
+			ru.RawQuery = q.Encode()
+			http.Redirect(w, r, ru.String(), http.StatusFound)
+			return
+		}
+
+		code, err := newRandomID()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := s.codes.Put(code, &AuthorizationCode{
+			ClientID:            req.ClientID,
+			RedirectURI:         req.RedirectURI,
+			Me:                  req.Me,
+			Scope:               req.Scope,
+			ResponseType:        req.ResponseType,
+			CodeChallenge:       req.CodeChallenge,
+			CodeChallengeMethod: req.CodeChallengeMethod,
+		}, s.codeTTL); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		q.Set("code", code)
+		ru.RawQuery = q.Encode()
+		http.Redirect(w, r, ru.String(), http.StatusFound)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// verifyHandlerRequest pulls the code/client_id/redirect_uri/code_verifier
+// out of a verification POST and redeems the matching authorization code,
+// shared by VerifyAuthHandler and TokenHandler.
+func (s *IndieAuthServer) verifyHandlerRequest(r *http.Request) (*AuthorizationCode, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	code := r.Form.Get("code")
+	if code == "" {
+		return nil, errors.New("indieauth: missing \"code\"")
+	}
+	ac, err := s.codes.Take(code)
+	if err != nil {
+		return nil, err
+	}
+	if ac.ClientID != r.Form.Get("client_id") {
+		return nil, errors.New("indieauth: \"client_id\" mismatch")
+	}
+	if ac.RedirectURI != r.Form.Get("redirect_uri") {
+		return nil, errors.New("indieauth: \"redirect_uri\" mismatch")
+	}
+	if ac.CodeChallenge != "" {
+		verifier := r.Form.Get("code_verifier")
+		if verifier == "" || codeChallenge(verifier, ac.CodeChallengeMethod) != ac.CodeChallenge {
+			return nil, errors.New("indieauth: PKCE verification failed")
+		}
+	}
+	return ac, nil
+}
+
+// VerifyAuthHandler is a HTTP handler implementing the authorization endpoint's
+// code verification step (POST to the authorization endpoint, per the spec),
+// it answers with {me, scope, client_id}.
+func (s *IndieAuthServer) VerifyAuthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ac, err := s.verifyHandlerRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]string{
+		"me":        ac.Me,
+		"scope":     ac.Scope,
+		"client_id": ac.ClientID,
+	})
+}
+
+// TokenHandler is a HTTP handler implementing the token_endpoint, it exchanges
+// a code for a bearer token scoped as requested during authorization.
+func (s *IndieAuthServer) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "indieauth: bad request", http.StatusBadRequest)
+		return
+	}
+
+	if r.Form.Get("action") == "revoke" {
+		s.revokeHandler(w, r)
+		return
+	}
+
+	ac, err := s.verifyHandlerRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ac.ResponseType != "code" {
+		http.Error(w, "indieauth: code was not issued for a token exchange", http.StatusBadRequest)
+		return
+	}
+	if ac.Scope == "" {
+		http.Error(w, "indieauth: no scope requested", http.StatusBadRequest)
+		return
+	}
+
+	token, err := newRandomID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.tokens.Put(token, &Token{
+		Me:       ac.Me,
+		ClientID: ac.ClientID,
+		Scope:    ac.Scope,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]string{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"scope":        ac.Scope,
+		"me":           ac.Me,
+	})
+}
+
+// revokeHandler implements the token endpoint's revocation semantics
+// (POST action=revoke), always answering 200 per the OAuth revocation spec.
+func (s *IndieAuthServer) revokeHandler(w http.ResponseWriter, r *http.Request) {
+	if token := r.Form.Get("token"); token != "" {
+		s.tokens.Delete(token)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// TokenVerifyHandler is a HTTP handler implementing the token_endpoint's
+// token introspection (GET with an Authorization: Bearer header), it answers
+// with {me, client_id, scope}.
+func (s *IndieAuthServer) TokenVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	token := bearerToken(r)
+	if token == "" {
+		http.Error(w, "indieauth: missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	tok, err := s.tokens.Get(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, map[string]string{
+		"me":        tok.Me,
+		"client_id": tok.ClientID,
+		"scope":     tok.Scope,
+	})
+}
+
+// bearerToken extracts the bearer token from the Authorization header, or
+// from the "access_token" query parameter as a fallback.
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// writeJSON writes v as a JSON response body with the appropriate content type.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// newRandomID generates a random hex identifier suitable for authorization
+// codes and bearer tokens.
+func newRandomID() (string, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", raw), nil
+}
+
+// memCodeEntry pairs an AuthorizationCode with its expiration time.
+type memCodeEntry struct {
+	data      *AuthorizationCode
+	expiresAt time.Time
+}
+
+// memCodeStore is the default in-memory CodeStore, backed by a
+// github.com/hashicorp/golang-lru cache. It is suitable for tests and
+// single-process deployments.
+type memCodeStore struct {
+	cache *lru.Cache
+}
+
+func newMemCodeStore(size int) (*memCodeStore, error) {
+	c, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &memCodeStore{cache: c}, nil
+}
+
+func (m *memCodeStore) Put(code string, data *AuthorizationCode, ttl time.Duration) error {
+	m.cache.Add(code, &memCodeEntry{data: data, expiresAt: time.Now().Add(ttl)})
+	return nil
+}
+
+func (m *memCodeStore) Take(code string) (*AuthorizationCode, error) {
+	v, ok := m.cache.Get(code)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	m.cache.Remove(code)
+	entry := v.(*memCodeEntry)
+	if time.Now().After(entry.expiresAt) {
+		return nil, ErrNotFound
+	}
+	return entry.data, nil
+}
+
+// memTokenStore is the default in-memory TokenStore, backed by a
+// github.com/hashicorp/golang-lru cache. It is suitable for tests and
+// single-process deployments.
+type memTokenStore struct {
+	cache *lru.Cache
+}
+
+func newMemTokenStore(size int) (*memTokenStore, error) {
+	c, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &memTokenStore{cache: c}, nil
+}
+
+func (m *memTokenStore) Put(token string, data *Token) error {
+	m.cache.Add(token, data)
+	return nil
+}
+
+func (m *memTokenStore) Get(token string) (*Token, error) {
+	v, ok := m.cache.Get(token)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v.(*Token), nil
+}
+
+func (m *memTokenStore) Delete(token string) error {
+	m.cache.Remove(token)
+	return nil
+}
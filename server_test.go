@@ -0,0 +1,268 @@
+package indieauth
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func newTestServer(t *testing.T, me string) *IndieAuthServer {
+	tpl := template.Must(template.New("consent").Parse(`consent for {{.Me}}`))
+	s, err := NewServer(func(r *http.Request) (string, bool) {
+		return me, true
+	}, WithConsentTemplate(tpl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// doAuthorization drives a full authorization_endpoint round-trip (GET then
+// POST with decision=allow) and returns the issued code.
+func doAuthorization(t *testing.T, s *IndieAuthServer, redirectURI string, extra url.Values) string {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", s.AuthorizationHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	q := url.Values{
+		"client_id":     {"https://client.example"},
+		"redirect_uri":  {redirectURI},
+		"state":         {"xyz"},
+		"response_type": {"code"},
+		"scope":         {"create"},
+	}
+	for k, v := range extra {
+		q[k] = v
+	}
+
+	resp, err := http.Get(server.URL + "/auth?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /auth: expected 200, got %d", resp.StatusCode)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	q.Set("decision", "allow")
+	resp, err = client.PostForm(server.URL+"/auth", q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("POST /auth: expected 302, got %d", resp.StatusCode)
+	}
+
+	loc, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Query().Get("state") != "xyz" {
+		t.Errorf("expected state to be echoed back, got %q", loc.Query().Get("state"))
+	}
+	code := loc.Query().Get("code")
+	if code == "" {
+		t.Fatal("expected a code to be issued")
+	}
+	return code
+}
+
+func TestServerAuthorizationAndTokenExchange(t *testing.T) {
+	s := newTestServer(t, "https://user.example")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", s.TokenHandler)
+	mux.HandleFunc("/token/verify", s.TokenVerifyHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	code := doAuthorization(t, s, "https://client.example/callback", nil)
+
+	vs := url.Values{
+		"code":         {code},
+		"client_id":    {"https://client.example"},
+		"redirect_uri": {"https://client.example/callback"},
+	}
+	resp, err := http.PostForm(server.URL+"/token", vs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /token: expected 200, got %d", resp.StatusCode)
+	}
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		Me          string `json:"me"`
+		Scope       string `json:"scope"`
+	}
+	if err := decodeJSON(resp, &tokenResp); err != nil {
+		t.Fatal(err)
+	}
+	if tokenResp.Me != "https://user.example" || tokenResp.Scope != "create" {
+		t.Errorf("unexpected token response: %+v", tokenResp)
+	}
+
+	// The code must not be redeemable a second time.
+	resp2, err := http.PostForm(server.URL+"/token", vs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp2.Body.Close()
+	if resp2.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected re-using a code to fail, got %d", resp2.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/token/verify", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenResp.AccessToken)
+	verifyResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer verifyResp.Body.Close()
+	if verifyResp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /token/verify: expected 200, got %d", verifyResp.StatusCode)
+	}
+	var introspect struct {
+		Me       string `json:"me"`
+		ClientID string `json:"client_id"`
+	}
+	if err := decodeJSON(verifyResp, &introspect); err != nil {
+		t.Fatal(err)
+	}
+	if introspect.Me != "https://user.example" || introspect.ClientID != "https://client.example" {
+		t.Errorf("unexpected introspection response: %+v", introspect)
+	}
+}
+
+func TestServerRevoke(t *testing.T) {
+	s := newTestServer(t, "https://user.example")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", s.TokenHandler)
+	mux.HandleFunc("/token/verify", s.TokenVerifyHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	code := doAuthorization(t, s, "https://client.example/callback", nil)
+	resp, err := http.PostForm(server.URL+"/token", url.Values{
+		"code":         {code},
+		"client_id":    {"https://client.example"},
+		"redirect_uri": {"https://client.example/callback"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := decodeJSON(resp, &tokenResp); err != nil {
+		t.Fatal(err)
+	}
+
+	revokeResp, err := http.PostForm(server.URL+"/token", url.Values{
+		"action": {"revoke"},
+		"token":  {tokenResp.AccessToken},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer revokeResp.Body.Close()
+	if revokeResp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /token?action=revoke: expected 200, got %d", revokeResp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("GET", server.URL+"/token/verify", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenResp.AccessToken)
+	verifyResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer verifyResp.Body.Close()
+	if verifyResp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a revoked token to be rejected, got %d", verifyResp.StatusCode)
+	}
+}
+
+func TestServerAuthorizationDenied(t *testing.T) {
+	s := newTestServer(t, "https://user.example")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", s.AuthorizationHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.PostForm(server.URL+"/auth", url.Values{
+		"client_id":     {"https://client.example"},
+		"redirect_uri":  {"https://client.example/callback"},
+		"state":         {"xyz"},
+		"response_type": {"code"},
+		"decision":      {"deny"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	loc, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Query().Get("error") != "access_denied" {
+		t.Errorf("expected error=access_denied, got %q", loc.RawQuery)
+	}
+}
+
+func TestServerAuthorizationRedirectURIMismatch(t *testing.T) {
+	s := newTestServer(t, "https://user.example")
+
+	// clientServer stands in for the client_id: a real site that doesn't
+	// advertise any rel="redirect_uri" link, so a cross-origin redirect_uri
+	// must be rejected instead of silently trusted.
+	clientMux := http.NewServeMux()
+	clientMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<!doctype html><html></html>`))
+	})
+	clientServer := httptest.NewServer(clientMux)
+	defer clientServer.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", s.AuthorizationHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	q := url.Values{
+		"client_id":     {clientServer.URL},
+		"redirect_uri":  {"https://evil.example/cb"},
+		"state":         {"xyz"},
+		"response_type": {"code"},
+		"scope":         {"create"},
+	}
+	resp, err := http.Get(server.URL + "/auth?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a redirect_uri not belonging to client_id to be rejected with 400, got %d", resp.StatusCode)
+	}
+}
+
+func decodeJSON(resp *http.Response, v interface{}) error {
+	return json.NewDecoder(resp.Body).Decode(v)
+}
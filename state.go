@@ -0,0 +1,144 @@
+package indieauth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/hashicorp/golang-lru"
+)
+
+// defaultStateTTL is how long a "state" stays valid while the user is away
+// at the authorization endpoint, if the caller doesn't override it.
+const defaultStateTTL = 10 * time.Minute
+
+// ErrorHandler lets integrators customize how RedirectHandler and
+// Middleware report flow errors (invalid state/me, upstream failures...),
+// instead of the default http.Error response.
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// SessionStore persists whether the current visitor is logged in, and as
+// whom, across requests. New and NewMulti install a default that wraps the
+// *sessions.CookieStore passed to them; use WithSessionStore to override it.
+type SessionStore interface {
+	// Get reports whether r belongs to a logged-in visitor, and if so, as
+	// which "me".
+	Get(r *http.Request) (loggedIn bool, me string, err error)
+	// Set logs r's visitor in as me.
+	Set(w http.ResponseWriter, r *http.Request, me string) error
+	// Clear logs r's visitor out.
+	Clear(w http.ResponseWriter, r *http.Request) error
+}
+
+// StateStore persists the data stashed under the "state" parameter while
+// the user is away at the authorization endpoint. New and NewMulti install
+// a default backed by an in-process LRU cache; use WithStateStore with a
+// shared backend (e.g. RedisStateStore) to run RedirectHandler behind
+// multiple processes.
+type StateStore interface {
+	// Put stashes rec under state for at most ttl.
+	Put(state string, rec *StateRecord, ttl time.Duration) error
+	// Take looks up and deletes the record stashed under state, so it can
+	// only ever be redeemed once. It returns ErrNotFound if state is
+	// unknown, already redeemed, or expired.
+	Take(state string) (*StateRecord, error)
+}
+
+// StateRecord is the data a StateStore associates with a "state" parameter:
+// the "me" and authorization endpoint the flow was started for, the URL to
+// return to, and the PKCE verifier (if any).
+type StateRecord struct {
+	Me           string
+	AuthEndpoint string
+	RedirectURL  string
+	Verifier     string
+}
+
+// WithSessionStore overrides the default gorilla-cookie-backed SessionStore.
+func WithSessionStore(store SessionStore) Option {
+	return func(ia *IndieAuth) { ia.sessions = store }
+}
+
+// WithStateStore overrides the default in-memory StateStore, e.g. with
+// RedisStateStore.
+func WithStateStore(store StateStore) Option {
+	return func(ia *IndieAuth) { ia.states = store }
+}
+
+// WithErrorHandler overrides how RedirectHandler and Middleware report flow
+// errors, instead of the default http.Error response.
+func WithErrorHandler(fn ErrorHandler) Option {
+	return func(ia *IndieAuth) { ia.errorHandler = fn }
+}
+
+// cookieSessionStore is the default SessionStore, backed by a gorilla
+// *sessions.CookieStore.
+type cookieSessionStore struct {
+	store *sessions.CookieStore
+}
+
+func newCookieSessionStore(store *sessions.CookieStore) *cookieSessionStore {
+	return &cookieSessionStore{store: store}
+}
+
+func (c *cookieSessionStore) Get(r *http.Request) (bool, string, error) {
+	session, err := c.store.Get(r, sessionName)
+	if err != nil {
+		return false, "", err
+	}
+	loggedIn, _ := session.Values["logged_in"].(bool)
+	me, _ := session.Values["me"].(string)
+	return loggedIn, me, nil
+}
+
+func (c *cookieSessionStore) Set(w http.ResponseWriter, r *http.Request, me string) error {
+	session, _ := c.store.Get(r, sessionName)
+	session.Values["logged_in"] = true
+	session.Values["me"] = me
+	return session.Save(r, w)
+}
+
+func (c *cookieSessionStore) Clear(w http.ResponseWriter, r *http.Request) error {
+	session, _ := c.store.Get(r, sessionName)
+	session.Values["logged_in"] = false
+	delete(session.Values, "me")
+	return session.Save(r, w)
+}
+
+// memStateEntry pairs a StateRecord with its expiration time.
+type memStateEntry struct {
+	rec       *StateRecord
+	expiresAt time.Time
+}
+
+// memStateStore is the default in-memory StateStore, backed by a
+// size-bounded LRU cache. It is not shared across processes.
+type memStateStore struct {
+	cache *lru.Cache
+}
+
+func newMemStateStore(size int) (*memStateStore, error) {
+	c, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &memStateStore{cache: c}, nil
+}
+
+func (m *memStateStore) Put(state string, rec *StateRecord, ttl time.Duration) error {
+	m.cache.Add(state, &memStateEntry{rec: rec, expiresAt: time.Now().Add(ttl)})
+	return nil
+}
+
+func (m *memStateStore) Take(state string) (*StateRecord, error) {
+	v, ok := m.cache.Get(state)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	m.cache.Remove(state)
+	entry := v.(*memStateEntry)
+	if time.Now().After(entry.expiresAt) {
+		return nil, ErrNotFound
+	}
+	return entry.rec, nil
+}